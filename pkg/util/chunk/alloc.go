@@ -0,0 +1,650 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pingcap/tidb/pkg/types"
+)
+
+// Allocator is an interface defined to reduce object allocation.
+// The typical usage is to call Reset() to recycle objects into a pool,
+// and Alloc() allocates from the pool.
+type Allocator interface {
+	Alloc(fields []*types.FieldType, initCap, maxChunkSize int) *Chunk
+	Reset()
+	CheckReuseAllocSize() bool
+	// Stats reports the allocator's current pool occupancy and hit/miss/
+	// eviction counters, so operators can size the reuse budget instead of
+	// guessing at it.
+	Stats() AllocatorStats
+}
+
+// maxFreeChunks and maxFreeColumnsPerType cap reuse by object count. They are
+// only consulted when the byte-budget mode below is disabled.
+var (
+	maxFreeChunks         = 64
+	maxFreeColumnsPerType = 256
+)
+
+// InitChunkAllocSize init maxFreeChunks and maxFreeColumnsPerType according to
+// the config of user.
+func InitChunkAllocSize(maxChunkSize, maxColumnSize int) {
+	maxFreeChunks = maxChunkSize
+	maxFreeColumnsPerType = maxColumnSize
+}
+
+// chunkBudgetBytes and columnBudgetBytes cap reuse by total memory held
+// instead of object count. A non-positive value disables the corresponding
+// budget and falls back to the count-based limits above.
+var (
+	chunkBudgetBytes  int64 = -1
+	columnBudgetBytes int64 = -1
+)
+
+// InitChunkAllocBytes switches the allocator to a byte-budget mode: pooled
+// chunks and columns are capped by the total memory they hold (roughly
+// cap(data)+cap(offsets)+cap(nullBitmap)) rather than by object count, and
+// the largest victims are evicted first when a put would exceed the budget.
+// This avoids a handful of large VARCHAR/JSON values either pinning tens of
+// MB (count-based limits let them through) or being dropped outright.
+// Passing non-positive values disables byte-budget mode.
+func InitChunkAllocBytes(chunkBudget, columnBudget int64) {
+	chunkBudgetBytes = chunkBudget
+	columnBudgetBytes = columnBudget
+}
+
+// AllocatorStats reports an Allocator's pool occupancy and hit/miss/eviction
+// counters, so operators can tune InitChunkAllocBytes against
+// tidb_mem_quota_query rather than guessing at counts.
+type AllocatorStats struct {
+	// ChunkBytes is the total bytes currently held by pooled (free) chunks.
+	// It is only maintained while a chunk byte budget is set (see
+	// InitChunkAllocBytes); under the count-based limits it stays 0.
+	ChunkBytes int64
+	// ChunkHits/ChunkMisses/ChunkEvictions count chunk (not column) pool events.
+	ChunkHits      int64
+	ChunkMisses    int64
+	ChunkEvictions int64
+	// ColumnBytes/ColumnHits/ColumnMisses/ColumnEvictions count column pool
+	// events per size class, keyed the same way as poolColumnAllocator.pool
+	// (getFixedLen result, or VarElemLen), so operators can tell which
+	// column type is holding the bytes or thrashing rather than seeing only
+	// an aggregate across every type.
+	ColumnBytes     map[int]int64
+	ColumnHits      map[int]int64
+	ColumnMisses    map[int]int64
+	ColumnEvictions map[int]int64
+}
+
+var _ Allocator = &allocator{}
+
+type allocator struct {
+	free      []*Chunk
+	freeBytes int64
+	// allocated holds every chunk handed out since the last Reset, so Reset
+	// can reclaim them all in one batch.
+	allocated   []*Chunk
+	columnAlloc poolColumnAllocator
+
+	hits, misses, evictions int64
+}
+
+// NewAllocator creates an Allocator.
+func NewAllocator() *allocator {
+	ret := &allocator{}
+	ret.columnAlloc.init()
+	return ret
+}
+
+// freeLen reports how many chunks are currently sitting in the free list,
+// ready to be handed out by the next Alloc without allocating fresh memory.
+// It exists purely so ShardedAllocator can peek whether a shard has
+// anything to reuse before deciding to steal from a neighbor.
+func (a *allocator) freeLen() int {
+	return len(a.free)
+}
+
+// CheckReuseAllocSize indicates whether the allocator is reusing memory.
+func (a *allocator) CheckReuseAllocSize() bool {
+	if chunkBudgetBytes > 0 && columnBudgetBytes > 0 {
+		return true
+	}
+	return (maxFreeChunks > 0) && (maxFreeColumnsPerType > 0)
+}
+
+// Alloc implements the Allocator interface.
+func (a *allocator) Alloc(fields []*types.FieldType, initCap, maxChunkSize int) *Chunk {
+	var chk *Chunk
+	if len(a.free) > 0 {
+		chk = a.free[len(a.free)-1]
+		a.free = a.free[:len(a.free)-1]
+		if chunkBudgetBytes > 0 {
+			a.freeBytes -= chunkMemSize(chk)
+		}
+		chk.columns = chk.columns[:0]
+		a.hits++
+	} else {
+		chk = new(Chunk)
+		a.misses++
+	}
+
+	for _, f := range fields {
+		chk.columns = append(chk.columns, a.columnAlloc.NewColumn(f, initCap))
+	}
+	chk.capacity = initCap
+	chk.requiredRows = maxChunkSize
+	a.allocated = append(a.allocated, chk)
+	return chk
+}
+
+// Reset implements the Allocator interface.
+func (a *allocator) Reset() {
+	for _, chk := range a.allocated {
+		// A chunk's columns may alias one another (see Chunk.MakeRef), so the
+		// same *Column must not be pushed onto a free list twice.
+		dedup := make(map[*Column]struct{}, len(chk.columns))
+		for _, col := range chk.columns {
+			if col.avoidReusing {
+				continue
+			}
+			if _, ok := dedup[col]; ok {
+				continue
+			}
+			dedup[col] = struct{}{}
+			a.columnAlloc.put(col)
+		}
+
+		if chunkBudgetBytes > 0 {
+			size := chunkMemSize(chk)
+			if size > chunkBudgetBytes {
+				// This chunk alone can't fit the budget; drop it rather than
+				// evicting everything else to make room for it.
+				a.evictions++
+				continue
+			}
+			for a.freeBytes+size > chunkBudgetBytes && len(a.free) > 0 {
+				a.evictLargestChunk()
+			}
+			a.free = append(a.free, chk)
+			a.freeBytes += size
+			continue
+		}
+
+		if len(a.free) < maxFreeChunks {
+			a.free = append(a.free, chk)
+		}
+	}
+	a.allocated = a.allocated[:0]
+}
+
+// Stats implements the Allocator interface.
+func (a *allocator) Stats() AllocatorStats {
+	stats := AllocatorStats{
+		ChunkBytes:      a.freeBytes,
+		ChunkHits:       a.hits,
+		ChunkMisses:     a.misses,
+		ChunkEvictions:  a.evictions,
+		ColumnBytes:     make(map[int]int64, len(a.columnAlloc.pool)),
+		ColumnHits:      make(map[int]int64, len(a.columnAlloc.pool)),
+		ColumnMisses:    make(map[int]int64, len(a.columnAlloc.pool)),
+		ColumnEvictions: make(map[int]int64, len(a.columnAlloc.pool)),
+	}
+	for sizeClass, tp := range a.columnAlloc.pool {
+		stats.ColumnBytes[sizeClass] += tp.bytes
+		for _, p := range tp.buckets {
+			stats.ColumnHits[sizeClass] += p.hits
+			stats.ColumnMisses[sizeClass] += p.misses
+			stats.ColumnEvictions[sizeClass] += p.evictions
+		}
+	}
+	return stats
+}
+
+func (a *allocator) evictLargestChunk() {
+	idx, best := 0, int64(-1)
+	for i, c := range a.free {
+		if size := chunkMemSize(c); size > best {
+			best, idx = size, i
+		}
+	}
+	a.freeBytes -= best
+	a.free = append(a.free[:idx], a.free[idx+1:]...)
+	a.evictions++
+}
+
+// chunkMemSize sums the memory held by a chunk's columns.
+func chunkMemSize(chk *Chunk) int64 {
+	var size int64
+	for _, col := range chk.columns {
+		size += columnMemSize(col)
+	}
+	return size
+}
+
+// columnMemSize approximates the memory held by a pooled column.
+func columnMemSize(col *Column) int64 {
+	return int64(cap(col.data) + cap(col.offsets) + cap(col.nullBitmap))
+}
+
+// ColumnAllocator defines the method to allocate a Column.
+type ColumnAllocator interface {
+	NewColumn(ft *types.FieldType, initCap int) *Column
+}
+
+// DefaultColumnAllocator is the default implementation of ColumnAllocator. It
+// does no pooling at all, simply delegating to NewColumn.
+type DefaultColumnAllocator struct{}
+
+// NewColumn implements the ColumnAllocator interface.
+func (DefaultColumnAllocator) NewColumn(ft *types.FieldType, initCap int) *Column {
+	return NewColumn(ft, initCap)
+}
+
+// freeList is a per-capacity-bucket pool of reusable columns. Byte-budget
+// bookkeeping lives one level up in columnTypePool, which is shared across
+// every bucket of a fixed-length size class.
+type freeList struct {
+	// allocColumns records every column ever allocated fresh for this
+	// bucket, for diagnostics.
+	allocColumns []*Column
+	columns      []*Column
+
+	hits, misses, evictions int64
+}
+
+func (p *freeList) Len() int {
+	return len(p.columns)
+}
+
+func (p *freeList) empty() bool {
+	return len(p.columns) == 0
+}
+
+func (p *freeList) pop() *Column {
+	col := p.columns[len(p.columns)-1]
+	p.columns = p.columns[:len(p.columns)-1]
+	return col
+}
+
+// columnTypePool holds every capacity bucket's free list for one fixed-length
+// size class, plus the bytes held across all of those buckets combined, so
+// columnBudgetBytes caps the size class as a whole instead of giving every
+// bucket its own independent budget.
+type columnTypePool struct {
+	buckets map[int]*freeList
+	bytes   int64
+}
+
+func (tp *columnTypePool) getFreeList(capBucket int) *freeList {
+	p, ok := tp.buckets[capBucket]
+	if !ok {
+		p = &freeList{}
+		tp.buckets[capBucket] = p
+	}
+	return p
+}
+
+func (tp *columnTypePool) pop(p *freeList) *Column {
+	col := p.pop()
+	tp.bytes -= columnMemSize(col)
+	return col
+}
+
+// push adds col to its capacity bucket. When budgetBytes is positive, the
+// largest column held across any of this type's buckets is evicted first to
+// make room; a column that alone exceeds the budget is dropped rather than
+// evicting everything else.
+func (tp *columnTypePool) push(capBucket int, col *Column, budgetBytes int64) {
+	size := columnMemSize(col)
+	if budgetBytes > 0 {
+		if size > budgetBytes {
+			// This column alone can't fit the budget; drop it rather than
+			// evicting everything else to make room for it, but still count
+			// it as an eviction so Stats reflects that it was discarded.
+			tp.getFreeList(capBucket).evictions++
+			return
+		}
+		for tp.bytes+size > budgetBytes {
+			tp.evictLargest()
+		}
+	}
+	p := tp.getFreeList(capBucket)
+	p.columns = append(p.columns, col)
+	tp.bytes += size
+}
+
+// evictLargest drops the single largest column held across any of this
+// type's capacity buckets, crediting the eviction to the bucket it came from.
+func (tp *columnTypePool) evictLargest() {
+	var victim *freeList
+	idx, best := 0, int64(-1)
+	for _, p := range tp.buckets {
+		for i, c := range p.columns {
+			if size := columnMemSize(c); size > best {
+				best, idx, victim = size, i, p
+			}
+		}
+	}
+	victim.columns = append(victim.columns[:idx], victim.columns[idx+1:]...)
+	victim.evictions++
+	tp.bytes -= best
+}
+
+// poolColumnAllocator allocates columns and maintains a free list per size
+// class. pool is keyed first by the column's fixed length (or VarElemLen
+// for variable length columns); each size class's columnTypePool further
+// splits its columns into capacity buckets (the column's element capacity,
+// or for variable length columns the byte capacity of its data, rounded up
+// to a power of two). Without the capacity bucket, a column that
+// grew to hold far more than a fresh column would either be kept alongside
+// much smaller columns (wasting memory when reused) or dropped entirely.
+type poolColumnAllocator struct {
+	pool map[int]*columnTypePool
+}
+
+var _ ColumnAllocator = &poolColumnAllocator{}
+
+func (alloc *poolColumnAllocator) init() {
+	alloc.pool = make(map[int]*columnTypePool)
+}
+
+func (alloc *poolColumnAllocator) getTypePool(fixedLen int) *columnTypePool {
+	tp, ok := alloc.pool[fixedLen]
+	if !ok {
+		tp = &columnTypePool{buckets: make(map[int]*freeList)}
+		alloc.pool[fixedLen] = tp
+	}
+	return tp
+}
+
+func (alloc *poolColumnAllocator) getFreeList(fixedLen, capBucket int) *freeList {
+	return alloc.getTypePool(fixedLen).getFreeList(capBucket)
+}
+
+// powerOfTwoBucket rounds n up to the next power of two, floored at 1, so
+// nearby capacities share a bucket instead of each getting its own.
+func powerOfTwoBucket(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	b := 1
+	for b < n {
+		b <<= 1
+	}
+	return b
+}
+
+// columnCapacity estimates how many elements col's backing array can hold,
+// which is what its capacity bucket is chosen from. For variable length
+// columns (fixedLen <= 0) it returns cap(col.data) in bytes, since their
+// element size is unknown.
+func columnCapacity(col *Column, fixedLen int) int {
+	if fixedLen <= 0 {
+		return cap(col.data)
+	}
+	return cap(col.data) / fixedLen
+}
+
+// smallestNonEmptyBucket returns the free list for the smallest bucket that
+// is at least minBucket and currently has a column to give out, so a
+// request for a small column can still be served by a pooled column that
+// grew larger than it needs, rather than allocating fresh.
+func smallestNonEmptyBucket(buckets map[int]*freeList, minBucket int) *freeList {
+	best := -1
+	for b, p := range buckets {
+		if b < minBucket || p.empty() {
+			continue
+		}
+		if best == -1 || b < best {
+			best = b
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	return buckets[best]
+}
+
+// NewColumn implements the ColumnAllocator interface.
+func (alloc *poolColumnAllocator) NewColumn(ft *types.FieldType, initCap int) *Column {
+	fixedLen := getFixedLen(ft)
+	wantBucket := powerOfTwoBucket(initCap)
+	if tp, ok := alloc.pool[fixedLen]; ok {
+		if p := smallestNonEmptyBucket(tp.buckets, wantBucket); p != nil {
+			p.hits++
+			return tp.pop(p)
+		}
+	}
+	p := alloc.getFreeList(fixedLen, wantBucket)
+	p.misses++
+	col := NewColumn(ft, initCap)
+	p.allocColumns = append(p.allocColumns, col)
+	return col
+}
+
+// put returns col to its size class and capacity bucket's free list, unless
+// it is flagged to avoid reuse. A column that grew much larger than typical
+// lands in its own capacity bucket instead of being dropped, so queries
+// that legitimately need that much space can still reuse it; columnBudgetBytes
+// caps the whole size class rather than each bucket separately, and the
+// per-bucket count limit keeps any one bucket from pinning unbounded memory.
+func (alloc *poolColumnAllocator) put(col *Column) {
+	if col.avoidReusing {
+		return
+	}
+
+	fixedLen := VarElemLen
+	if col.elemBuf != nil {
+		fixedLen = len(col.elemBuf)
+	}
+	capBucket := powerOfTwoBucket(columnCapacity(col, fixedLen))
+	tp := alloc.getTypePool(fixedLen)
+
+	if columnBudgetBytes > 0 {
+		tp.push(capBucket, col, columnBudgetBytes)
+		return
+	}
+	if tp.getFreeList(capBucket).Len() >= maxFreeColumnsPerType {
+		return
+	}
+	tp.push(capBucket, col, 0)
+}
+
+var _ Allocator = &syncAllocator{}
+
+// syncAllocator wraps an Allocator with a mutex, so it can be shared safely
+// by multiple goroutines.
+type syncAllocator struct {
+	mu    sync.Mutex
+	alloc Allocator
+}
+
+// NewSyncAllocator creates an Allocator from alloc that can be used
+// concurrently.
+func NewSyncAllocator(alloc Allocator) *syncAllocator {
+	return &syncAllocator{alloc: alloc}
+}
+
+// Alloc implements the Allocator interface.
+func (a *syncAllocator) Alloc(fields []*types.FieldType, initCap, maxChunkSize int) *Chunk {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.alloc.Alloc(fields, initCap, maxChunkSize)
+}
+
+// Reset implements the Allocator interface.
+func (a *syncAllocator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.alloc.Reset()
+}
+
+// CheckReuseAllocSize implements the Allocator interface.
+func (a *syncAllocator) CheckReuseAllocSize() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.alloc.CheckReuseAllocSize()
+}
+
+// Stats implements the Allocator interface.
+func (a *syncAllocator) Stats() AllocatorStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.alloc.Stats()
+}
+
+// freeLen reports how many chunks are sitting in the underlying allocator's
+// free list, for ShardedAllocator's steal-on-miss decision. It returns 0 if
+// the wrapped Allocator doesn't expose one.
+func (a *syncAllocator) freeLen() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p, ok := a.alloc.(interface{ freeLen() int }); ok {
+		return p.freeLen()
+	}
+	return 0
+}
+
+var _ Allocator = &reuseHookAllocator{}
+
+// reuseHookAllocator wraps an Allocator and invokes hook on the first Alloc
+// for which the underlying allocator's CheckReuseAllocSize reports that reuse
+// is enabled, whether or not that Alloc is served from pooled memory. This is
+// used to fire reuse-related metrics/telemetry exactly once per Allocator
+// lifetime rather than on every Alloc call.
+type reuseHookAllocator struct {
+	Allocator
+	hook     func()
+	hookOnce sync.Once
+}
+
+// NewReuseHookAllocator creates an Allocator that calls hook once, on the
+// first Alloc made while alloc.CheckReuseAllocSize returns true.
+func NewReuseHookAllocator(alloc Allocator, hook func()) *reuseHookAllocator {
+	return &reuseHookAllocator{Allocator: alloc, hook: hook}
+}
+
+// Alloc implements the Allocator interface.
+func (a *reuseHookAllocator) Alloc(fields []*types.FieldType, initCap, maxChunkSize int) *Chunk {
+	if a.Allocator.CheckReuseAllocSize() {
+		a.hookOnce.Do(a.hook)
+	}
+	return a.Allocator.Alloc(fields, initCap, maxChunkSize)
+}
+
+var _ Allocator = &ShardedAllocator{}
+
+// ShardedAllocator spreads chunk/column reuse across a fixed number of
+// independent Allocator shards, each guarded by its own mutex, to remove
+// the single shared mutex of SyncAllocator as a contention point under high
+// concurrency (many sessions, parallel executors all hammering one pool).
+type ShardedAllocator struct {
+	shards []*syncAllocator
+	rr     atomic.Uint64
+}
+
+// NewShardedAllocator creates a ShardedAllocator with the given number of
+// shards, each an independent Allocator constructed by calling base.
+func NewShardedAllocator(base func() Allocator, shards int) *ShardedAllocator {
+	if shards <= 0 {
+		shards = 1
+	}
+	sa := &ShardedAllocator{shards: make([]*syncAllocator, shards)}
+	for i := range sa.shards {
+		sa.shards[i] = NewSyncAllocator(base())
+	}
+	return sa
+}
+
+// pick selects a shard. runtime_procPin is not exported, so a simple atomic
+// round-robin counter is used instead; it spreads load evenly without
+// needing per-goroutine affinity.
+func (a *ShardedAllocator) pick() int {
+	return int(a.rr.Add(1) % uint64(len(a.shards)))
+}
+
+// Alloc implements the Allocator interface. The call is served by a
+// round-robin-selected shard; only when that shard's own free list is
+// empty (a real miss) do we look at neighboring shards for a chunk to
+// steal, and only when reuse is enabled at all, so the common hit path
+// never touches another shard's mutex.
+func (a *ShardedAllocator) Alloc(fields []*types.FieldType, initCap, maxChunkSize int) *Chunk {
+	idx := a.pick()
+	shard := a.shards[idx]
+	// CheckReuseAllocSize only reflects the global budget/count vars, which
+	// are identical for every shard, so a single shard's answer is enough —
+	// ShardedAllocator.CheckReuseAllocSize's fan-out over every shard's
+	// mutex would otherwise be paid on every miss.
+	if shard.freeLen() == 0 && shard.CheckReuseAllocSize() {
+		for i := 1; i < len(a.shards); i++ {
+			neighbor := a.shards[(idx+i)%len(a.shards)]
+			if neighbor.freeLen() > 0 {
+				shard = neighbor
+				break
+			}
+		}
+	}
+	return shard.Alloc(fields, initCap, maxChunkSize)
+}
+
+// Reset implements the Allocator interface, fanning out to every shard.
+func (a *ShardedAllocator) Reset() {
+	for _, shard := range a.shards {
+		shard.Reset()
+	}
+}
+
+// CheckReuseAllocSize implements the Allocator interface.
+func (a *ShardedAllocator) CheckReuseAllocSize() bool {
+	for _, shard := range a.shards {
+		if shard.CheckReuseAllocSize() {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats implements the Allocator interface, summing counters across shards.
+func (a *ShardedAllocator) Stats() AllocatorStats {
+	total := AllocatorStats{
+		ColumnBytes:     make(map[int]int64),
+		ColumnHits:      make(map[int]int64),
+		ColumnMisses:    make(map[int]int64),
+		ColumnEvictions: make(map[int]int64),
+	}
+	for _, shard := range a.shards {
+		s := shard.Stats()
+		total.ChunkBytes += s.ChunkBytes
+		total.ChunkHits += s.ChunkHits
+		total.ChunkMisses += s.ChunkMisses
+		total.ChunkEvictions += s.ChunkEvictions
+		for sizeClass, n := range s.ColumnBytes {
+			total.ColumnBytes[sizeClass] += n
+		}
+		for sizeClass, n := range s.ColumnHits {
+			total.ColumnHits[sizeClass] += n
+		}
+		for sizeClass, n := range s.ColumnMisses {
+			total.ColumnMisses[sizeClass] += n
+		}
+		for sizeClass, n := range s.ColumnEvictions {
+			total.ColumnEvictions[sizeClass] += n
+		}
+	}
+	return total
+}
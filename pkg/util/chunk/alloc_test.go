@@ -15,6 +15,7 @@
 package chunk
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -114,7 +115,9 @@ func TestColumnAllocator(t *testing.T) {
 	}
 
 	// Check max column size.
-	freeList := alloc1.pool[getFixedLen(ft)]
+	tp := alloc1.pool[getFixedLen(ft)]
+	require.NotNil(t, tp)
+	freeList := tp.buckets[powerOfTwoBucket(20)]
 	require.NotNil(t, freeList)
 	require.Equal(t, freeList.Len(), maxFreeColumnsPerType)
 }
@@ -143,13 +146,15 @@ func TestNoDuplicateColumnReuse(t *testing.T) {
 
 	a := alloc.columnAlloc
 	// Make sure no duplicated column in the pool.
-	for _, p := range a.pool {
-		dup := make(map[*Column]struct{})
-		for !p.empty() {
-			c := p.pop()
-			_, exist := dup[c]
-			require.False(t, exist)
-			dup[c] = struct{}{}
+	for _, tp := range a.pool {
+		for _, p := range tp.buckets {
+			dup := make(map[*Column]struct{})
+			for !p.empty() {
+				c := p.pop()
+				_, exist := dup[c]
+				require.False(t, exist)
+				dup[c] = struct{}{}
+			}
 		}
 	}
 }
@@ -180,8 +185,10 @@ func TestAvoidColumnReuse(t *testing.T) {
 
 	a := alloc.columnAlloc
 	// Make sure no duplicated column in the pool.
-	for _, p := range a.pool {
-		require.True(t, p.empty())
+	for _, tp := range a.pool {
+		for _, p := range tp.buckets {
+			require.True(t, p.empty())
+		}
 	}
 
 	// test decoder will set avoid reusing flag.
@@ -225,8 +232,10 @@ func TestColumnAllocatorLimit(t *testing.T) {
 	}
 	alloc.Reset()
 	require.Equal(t, len(alloc.free), 10)
-	for _, p := range alloc.columnAlloc.pool {
-		require.True(t, (p.Len() <= 20))
+	for _, tp := range alloc.columnAlloc.pool {
+		for _, p := range tp.buckets {
+			require.True(t, (p.Len() <= 20))
+		}
 	}
 
 	//Reduce capacity
@@ -237,8 +246,10 @@ func TestColumnAllocatorLimit(t *testing.T) {
 	}
 	alloc.Reset()
 	require.Equal(t, len(alloc.free), 5)
-	for _, p := range alloc.columnAlloc.pool {
-		require.True(t, (p.Len() <= 10))
+	for _, tp := range alloc.columnAlloc.pool {
+		for _, p := range tp.buckets {
+			require.True(t, (p.Len() <= 10))
+		}
 	}
 
 	//increase capacity
@@ -249,30 +260,68 @@ func TestColumnAllocatorLimit(t *testing.T) {
 	}
 	alloc.Reset()
 	require.Equal(t, len(alloc.free), 50)
-	for _, p := range alloc.columnAlloc.pool {
-		require.True(t, (p.Len() <= 100))
+	for _, tp := range alloc.columnAlloc.pool {
+		for _, p := range tp.buckets {
+			require.True(t, (p.Len() <= 100))
+		}
 	}
 
-	//long characters are not cached
+	//long characters get their own capacity bucket instead of being dropped
 	alloc = NewAllocator()
 	rs := alloc.Alloc([]*types.FieldType{types.NewFieldTypeBuilder().SetType(mysql.TypeVarchar).BuildP()}, 1024, 1024)
-	nu := len(alloc.columnAlloc.pool[VarElemLen].allocColumns)
+	smallBucket := powerOfTwoBucket(1024)
+	nu := len(alloc.columnAlloc.pool[VarElemLen].buckets[smallBucket].allocColumns)
 	require.Equal(t, nu, 1)
 	for _, col := range rs.columns {
 		for range 20480 {
 			col.data = append(col.data, byte('a'))
 		}
 	}
+	grownBucket := powerOfTwoBucket(cap(rs.columns[0].data))
+	require.True(t, grownBucket > smallBucket)
 	alloc.Reset()
-	for _, p := range alloc.columnAlloc.pool {
-		require.True(t, (p.Len() == 0))
-	}
+	require.Equal(t, alloc.columnAlloc.pool[VarElemLen].buckets[grownBucket].Len(), 1)
+	require.Equal(t, alloc.columnAlloc.pool[VarElemLen].buckets[smallBucket].Len(), 0)
 
 	InitChunkAllocSize(0, 0)
 	alloc = NewAllocator()
 	require.False(t, alloc.CheckReuseAllocSize())
 }
 
+func TestChunkAllocBytesBudget(t *testing.T) {
+	fieldTypes := []*types.FieldType{
+		types.NewFieldTypeBuilder().SetType(mysql.TypeVarchar).BuildP(),
+	}
+
+	// A tiny column budget should evict the larger of two pooled columns
+	// rather than pinning both, while a bigger one is able to hold it.
+	InitChunkAllocBytes(1<<20, 64)
+	defer InitChunkAllocBytes(-1, -1)
+
+	alloc := NewAllocator()
+	require.True(t, alloc.CheckReuseAllocSize())
+
+	small := alloc.Alloc(fieldTypes, 5, 10)
+	small.columns[0].data = append(small.columns[0].data, make([]byte, 16)...)
+	large := alloc.Alloc(fieldTypes, 5, 10)
+	large.columns[0].data = append(large.columns[0].data, make([]byte, 128)...)
+	alloc.Reset()
+
+	tp := alloc.columnAlloc.pool[VarElemLen]
+	require.NotNil(t, tp)
+	// The budget is shared across every capacity bucket of this size class,
+	// not handed out separately to each one.
+	require.True(t, tp.bytes <= 64)
+	var totalEvictions int64
+	for _, p := range tp.buckets {
+		totalEvictions += p.evictions
+	}
+	require.True(t, totalEvictions > 0)
+
+	stats := alloc.Stats()
+	require.True(t, stats.ColumnEvictions[VarElemLen] > 0)
+}
+
 func TestColumnAllocatorCheck(t *testing.T) {
 	fieldTypes := []*types.FieldType{
 		types.NewFieldTypeBuilder().SetType(mysql.TypeFloat).BuildP(),
@@ -286,9 +335,10 @@ func TestColumnAllocatorCheck(t *testing.T) {
 	col := alloc.columnAlloc.NewColumn(types.NewFieldTypeBuilder().SetType(mysql.TypeFloat).BuildP(), 10)
 	col.Reset(types.ETDatetime)
 	alloc.Reset()
-	num := alloc.columnAlloc.pool[getFixedLen(types.NewFieldTypeBuilder().SetType(mysql.TypeFloat).BuildP())].Len()
+	bucket := powerOfTwoBucket(5)
+	num := alloc.columnAlloc.pool[getFixedLen(types.NewFieldTypeBuilder().SetType(mysql.TypeFloat).BuildP())].buckets[bucket].Len()
 	require.Equal(t, num, 4)
-	num = alloc.columnAlloc.pool[getFixedLen(types.NewFieldTypeBuilder().SetType(mysql.TypeDatetime).BuildP())].Len()
+	num = alloc.columnAlloc.pool[getFixedLen(types.NewFieldTypeBuilder().SetType(mysql.TypeDatetime).BuildP())].buckets[bucket].Len()
 	require.Equal(t, num, 4)
 }
 
@@ -359,3 +409,99 @@ func TestSyncAllocator(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestShardedAllocator(t *testing.T) {
+	fieldTypes := []*types.FieldType{
+		types.NewFieldType(mysql.TypeVarchar),
+		types.NewFieldType(mysql.TypeJSON),
+		types.NewFieldType(mysql.TypeFloat),
+		types.NewFieldType(mysql.TypeNewDecimal),
+		types.NewFieldType(mysql.TypeDouble),
+		types.NewFieldType(mysql.TypeLonglong),
+		types.NewFieldType(mysql.TypeTimestamp),
+		types.NewFieldType(mysql.TypeDatetime),
+	}
+
+	alloc := NewShardedAllocator(func() Allocator { return NewAllocator() }, 16)
+
+	wg := &sync.WaitGroup{}
+	for range 1000 {
+		wg.Add(1)
+		go func() {
+			for range 10 {
+				for range 100 {
+					chk := alloc.Alloc(fieldTypes, 5, 100)
+					require.NotNil(t, chk)
+				}
+				alloc.Reset()
+			}
+
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestShardedAllocatorSteals(t *testing.T) {
+	fieldTypes := []*types.FieldType{types.NewFieldType(mysql.TypeLonglong)}
+	sa := NewShardedAllocator(func() Allocator { return NewAllocator() }, 2)
+
+	// pick() starts its round-robin counter at 1, so the first call lands on
+	// shards[1]; it's a fresh allocation since every shard starts empty.
+	chk1 := sa.Alloc(fieldTypes, 5, 10)
+	require.NotNil(t, chk1)
+	sa.Reset()
+	require.Equal(t, 0, sa.shards[0].freeLen())
+	require.Equal(t, 1, sa.shards[1].freeLen())
+
+	// The second call lands on shards[0], which has nothing to reuse; it
+	// should steal the chunk shards[1] just freed instead of allocating.
+	chk2 := sa.Alloc(fieldTypes, 5, 10)
+	require.NotNil(t, chk2)
+	require.Equal(t, 0, sa.shards[1].freeLen())
+
+	stats := sa.Stats()
+	require.Equal(t, int64(1), stats.ChunkHits)
+	require.Equal(t, int64(1), stats.ChunkMisses)
+}
+
+func benchmarkAllocator(b *testing.B, alloc Allocator, goroutines int) {
+	fieldTypes := []*types.FieldType{
+		types.NewFieldType(mysql.TypeVarchar),
+		types.NewFieldType(mysql.TypeLonglong),
+	}
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	perGoroutine := b.N/goroutines + 1
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perGoroutine {
+				alloc.Alloc(fieldTypes, 5, 100)
+			}
+			alloc.Reset()
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkSyncAllocator and BenchmarkShardedAllocator compare a single
+// shared mutex against a sharded pool at increasing concurrency, to show the
+// contention ShardedAllocator is meant to remove.
+func BenchmarkSyncAllocator(b *testing.B) {
+	for _, goroutines := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("goroutines=%d", goroutines), func(b *testing.B) {
+			benchmarkAllocator(b, NewSyncAllocator(NewAllocator()), goroutines)
+		})
+	}
+}
+
+func BenchmarkShardedAllocator(b *testing.B) {
+	for _, goroutines := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("goroutines=%d", goroutines), func(b *testing.B) {
+			benchmarkAllocator(b, NewShardedAllocator(func() Allocator { return NewAllocator() }, 16), goroutines)
+		})
+	}
+}